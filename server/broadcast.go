@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Broadcast encodes v once into a websocket.PreparedMessage and fans it out
+// concurrently to every connection in conns, returning the per-connection
+// enqueue error in the same order as conns (nil where the message was
+// successfully handed to that connection's send queue). Because
+// WritePreparedMessage only enqueues the write - the actual network write
+// happens later on each connection's writer goroutine - a nil entry here
+// means "queued", not "delivered": a slow or dead peer's write can still
+// fail afterward. Callers that need to know about delivery failures, not
+// just enqueue failures, should watch the corresponding SafeConn's Done
+// channel and Err method. Encoding v once up front means the JSON marshaling
+// - and any negotiated permessage-deflate compression - happens a single
+// time regardless of how many connections receive it.
+func Broadcast(conns []*SafeConn, v any) []error {
+	errs := make([]error, len(conns))
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	pm, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	for i, c := range conns {
+		go func(i int, c *SafeConn) {
+			defer wg.Done()
+			errs[i] = c.WritePreparedMessage(pm)
+		}(i, c)
+	}
+	wg.Wait()
+
+	return errs
+}
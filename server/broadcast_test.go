@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestBroadcast tests that Broadcast fans a single payload out to every
+// connection and that each recipient sees the same decoded value.
+func TestBroadcast(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	const numClients = 5
+	received := make(chan []byte, numClients)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Errorf("Server read failed: %v", err)
+			return
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + server.URL[4:]
+	conns := make([]*SafeConn, numClients)
+	for i := 0; i < numClients; i++ {
+		clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect client %d: %v", i, err)
+		}
+		defer clientConn.Close()
+		conns[i] = NewSafeConn(clientConn)
+	}
+
+	payload := map[string]any{"event": "card-detected", "uid": "04A1B2C3"}
+	errs := Broadcast(conns, payload)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Broadcast to conn %d failed: %v", i, err)
+		}
+	}
+
+	for i := 0; i < numClients; i++ {
+		select {
+		case msg := <-received:
+			var got map[string]any
+			if err := json.Unmarshal(msg, &got); err != nil {
+				t.Errorf("Failed to unmarshal received message: %v", err)
+				continue
+			}
+			if got["uid"] != payload["uid"] {
+				t.Errorf("Expected uid %v, got %v", payload["uid"], got["uid"])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for broadcast message")
+		}
+	}
+}
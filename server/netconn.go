@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// netConn adapts a SafeConn to the net.Conn interface by framing an
+// arbitrary byte stream over websocket.BinaryMessage frames. This lets
+// existing byte-stream protocols - a PC/SC-style APDU channel, an SSH-like
+// admin tunnel to the NFC agent - run over the same websocket connection the
+// rest of this module already uses, without every caller reimplementing
+// frame reassembly.
+type netConn struct {
+	sc  *SafeConn
+	buf []byte // leftover bytes from the last binary frame read
+}
+
+// NetConn presents sc as a net.Conn. Read discards text frames (so
+// control/JSON traffic can still flow over the same connection) and returns
+// the payload of binary frames, buffering any bytes left over between calls.
+// Write sends p as a single binary frame. Close sends a close frame before
+// closing the underlying connection.
+func NetConn(sc *SafeConn) net.Conn {
+	return &netConn{sc: sc}
+}
+
+// Read implements net.Conn. It blocks until a binary frame is available,
+// skipping over any text frames, and copies from the current frame (or any
+// bytes buffered from a previous frame) into p.
+func (nc *netConn) Read(p []byte) (int, error) {
+	for len(nc.buf) == 0 {
+		messageType, data, err := nc.sc.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		nc.buf = data
+	}
+
+	n := copy(p, nc.buf)
+	nc.buf = nc.buf[n:]
+	return n, nil
+}
+
+// Write implements net.Conn, sending p as a single binary frame.
+//
+// Write only enqueues the frame onto the underlying SafeConn's send queue;
+// by the time it returns, the frame may not have reached the network yet; a
+// write failure (e.g. the peer going away) surfaces later, on whichever
+// Write happens to be enqueued after the writer goroutine notices. This
+// differs from the synchronous-error contract most net.Conn callers expect.
+// To detect a dead connection promptly rather than on some unrelated later
+// Write, callers should select on the SafeConn's Done channel (or poll Err)
+// alongside their own use of this net.Conn; Write itself does this on a
+// best-effort basis, returning the stored error immediately if the writer
+// goroutine has already exited.
+func (nc *netConn) Write(p []byte) (int, error) {
+	if err := nc.sc.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-nc.sc.Done():
+		return 0, nc.sc.Err()
+	default:
+		return len(p), nil
+	}
+}
+
+// Close sends a close frame and closes the underlying connection.
+func (nc *netConn) Close() error {
+	nc.sc.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+	return nc.sc.Close()
+}
+
+func (nc *netConn) LocalAddr() net.Addr  { return nc.sc.Conn().LocalAddr() }
+func (nc *netConn) RemoteAddr() net.Addr { return nc.sc.Conn().RemoteAddr() }
+
+// SetDeadline maps to the underlying connection's read and write deadlines.
+func (nc *netConn) SetDeadline(t time.Time) error {
+	if err := nc.sc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return nc.sc.SetWriteDeadline(t)
+}
+
+// SetReadDeadline maps to the underlying connection's read deadline.
+func (nc *netConn) SetReadDeadline(t time.Time) error {
+	return nc.sc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline maps to the underlying connection's write deadline.
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	return nc.sc.SetWriteDeadline(t)
+}
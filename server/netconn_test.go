@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialNetConnPair starts a websocket echo-free pair: it upgrades the server
+// side and returns both ends wrapped as net.Conn via NetConn.
+func dialNetConnPair(t *testing.T) (client, serverSide net.Conn, cleanup func()) {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	serverReady := make(chan struct{})
+	var serverConn *websocket.Conn
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		serverConn = conn
+		close(serverReady)
+	}))
+
+	wsURL := "ws" + server.URL[4:]
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	<-serverReady
+
+	client = NetConn(NewSafeConn(clientConn))
+	serverSide = NetConn(NewSafeConn(serverConn))
+
+	return client, serverSide, func() {
+		client.Close()
+		serverSide.Close()
+		server.Close()
+	}
+}
+
+// TestNetConnReadWrite tests a basic round trip over the adapter.
+func TestNetConnReadWrite(t *testing.T) {
+	client, serverSide, cleanup := dialNetConnPair(t)
+	defer cleanup()
+
+	payload := []byte("hello over net.Conn")
+	if _, err := client.Write(payload); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(serverSide, buf); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Errorf("Expected %q, got %q", payload, buf)
+	}
+}
+
+// TestNetConnReadSpansShortReads tests that a single frame larger than the
+// caller's buffer is reassembled correctly across multiple short Read calls.
+func TestNetConnReadSpansShortReads(t *testing.T) {
+	client, serverSide, cleanup := dialNetConnPair(t)
+	defer cleanup()
+
+	payload := bytes.Repeat([]byte("0123456789"), 100) // 1000 bytes, one frame
+	if _, err := client.Write(payload); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	var got bytes.Buffer
+	small := make([]byte, 7) // deliberately not a divisor of len(payload)
+	for got.Len() < len(payload) {
+		n, err := serverSide.Read(small)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		got.Write(small[:n])
+	}
+
+	if !bytes.Equal(got.Bytes(), payload) {
+		t.Errorf("Reassembled payload does not match: got %d bytes, want %d", got.Len(), len(payload))
+	}
+}
+
+// TestNetConnConcurrentWriters tests that concurrent Write calls don't panic
+// and that every byte written is eventually read back.
+func TestNetConnConcurrentWriters(t *testing.T) {
+	client, serverSide, cleanup := dialNetConnPair(t)
+	defer cleanup()
+
+	const numWriters = 20
+	const frameSize = 16
+
+	var wg sync.WaitGroup
+	wg.Add(numWriters)
+	for i := 0; i < numWriters; i++ {
+		go func(id byte) {
+			defer wg.Done()
+			frame := bytes.Repeat([]byte{id}, frameSize)
+			if _, err := client.Write(frame); err != nil {
+				t.Errorf("Write failed: %v", err)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+
+	total := 0
+	buf := make([]byte, frameSize)
+	for total < numWriters*frameSize {
+		n, err := serverSide.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		total += n
+	}
+
+	if total != numWriters*frameSize {
+		t.Errorf("Expected %d total bytes, got %d", numWriters*frameSize, total)
+	}
+}
+
+// TestNetConnReadDeadline tests that SetReadDeadline propagates to the
+// underlying connection and causes Read to return once it elapses.
+func TestNetConnReadDeadline(t *testing.T) {
+	_, serverSide, cleanup := dialNetConnPair(t)
+	defer cleanup()
+
+	if err := serverSide.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline failed: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := serverSide.Read(buf); err == nil {
+		t.Fatal("Expected Read to fail after read deadline elapsed")
+	}
+}
@@ -2,51 +2,401 @@
 package server
 
 import (
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// SafeConn wraps a websocket.Conn with a mutex to prevent concurrent writes.
-// The gorilla/websocket library does not support concurrent writes to the same
-// connection, so all writes must be serialized.
+// writeWait is the time allowed to write a control message (e.g. a ping) to
+// the peer before the write is considered failed.
+const writeWait = 10 * time.Second
+
+// ErrSendQueueFull is returned when a SafeConn's send queue is full and the
+// configured FullQueuePolicy gives up rather than waiting indefinitely.
+var ErrSendQueueFull = errors.New("server: send queue full")
+
+// ErrConnClosed is returned by write methods once a SafeConn's writer
+// goroutine has exited, whether because Close was called or because a
+// previous write failed. If the goroutine stopped on an error (a failed
+// write, or PolicyClose), write methods return that error instead; see Err.
+var ErrConnClosed = errors.New("server: connection closed")
+
+// FullQueuePolicy controls what a SafeConn does when a write is enqueued
+// while its send queue is already full.
+type FullQueuePolicy int
+
+const (
+	// PolicyBlock blocks the caller for up to SafeConnOptions.WriteWait
+	// waiting for room in the send queue, returning ErrSendQueueFull if none
+	// becomes available in time. This is the default.
+	PolicyBlock FullQueuePolicy = iota
+	// PolicyDropOldest discards the oldest queued message to make room for
+	// the new one, favoring freshness over completeness.
+	PolicyDropOldest
+	// PolicyClose closes the connection as soon as its send queue is full,
+	// so one slow client cannot hold an unbounded backlog of stale writes.
+	PolicyClose
+)
+
+// SafeConnOptions configures the behavior of a SafeConn's writer goroutine.
+type SafeConnOptions struct {
+	// SendBufferSize is the capacity of the bounded send queue.
+	SendBufferSize int
+	// WriteWait is both the deadline applied to each underlying network
+	// write and, under PolicyBlock, the maximum time a caller will wait for
+	// room in the send queue.
+	WriteWait time.Duration
+	// FullQueuePolicy selects what happens when the send queue is full.
+	FullQueuePolicy FullQueuePolicy
+}
+
+// DefaultSafeConnOptions are the options used by NewSafeConn.
+var DefaultSafeConnOptions = SafeConnOptions{
+	SendBufferSize:  256,
+	WriteWait:       writeWait,
+	FullQueuePolicy: PolicyBlock,
+}
+
+// msgKind identifies which underlying websocket.Conn method a queuedMsg
+// should be written with.
+type msgKind int
+
+const (
+	kindJSON msgKind = iota
+	kindRaw
+	kindPrepared
+	kindControl
+	kindEnableCompression
+	kindSetCompressionLevel
+	kindSetWriteDeadline
+)
+
+// queuedMsg is one entry in a SafeConn's send queue.
+type queuedMsg struct {
+	kind        msgKind
+	value       any                        // kindJSON
+	messageType int                        // kindRaw, kindControl
+	data        []byte                     // kindRaw, kindControl
+	prepared    *websocket.PreparedMessage // kindPrepared
+	deadline    time.Time                  // kindControl, kindSetWriteDeadline
+	boolValue   bool                       // kindEnableCompression
+	intValue    int                        // kindSetCompressionLevel
+}
+
+// SafeConn wraps a websocket.Conn with a dedicated writer goroutine and a
+// bounded send queue, so that writes from any number of producer goroutines
+// (an NFC reader loop, event publishers, the ping loop, ...) never block on
+// network I/O. The gorilla/websocket library does not support concurrent
+// writes to the same connection; routing every write through one goroutine
+// is what makes that safe here, and it also means a single slow client can no
+// longer stall every producer waiting on a lock - the FullQueuePolicy decides
+// what happens instead.
 type SafeConn struct {
 	conn *websocket.Conn
-	mu   sync.Mutex
+	opts SafeConnOptions
+
+	send    chan queuedMsg
+	closing chan struct{}
+	done    chan struct{}
+
+	closeOnce sync.Once
+	mu        sync.Mutex
+	err       error
+
+	// writeDeadline overrides the per-write deadline derived from
+	// opts.WriteWait once SetWriteDeadline has been called. It is only ever
+	// read and written by the writer goroutine (see write and
+	// SetWriteDeadline), so it needs no synchronization of its own.
+	writeDeadline time.Time
 }
 
-// NewSafeConn creates a new SafeConn wrapping the given websocket connection.
+// NewSafeConn creates a new SafeConn wrapping the given websocket connection,
+// using DefaultSafeConnOptions.
 func NewSafeConn(conn *websocket.Conn) *SafeConn {
-	return &SafeConn{conn: conn}
+	return NewSafeConnWithOptions(conn, DefaultSafeConnOptions)
 }
 
-// WriteJSON writes a JSON message to the connection in a thread-safe manner.
-func (sc *SafeConn) WriteJSON(v any) error {
+// NewSafeConnWithOptions creates a new SafeConn wrapping the given websocket
+// connection, configured by opts.
+func NewSafeConnWithOptions(conn *websocket.Conn, opts SafeConnOptions) *SafeConn {
+	sc := &SafeConn{
+		conn:    conn,
+		opts:    opts,
+		send:    make(chan queuedMsg, opts.SendBufferSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go sc.writeLoop()
+	return sc
+}
+
+// writeLoop is the sole goroutine that writes to sc.conn. It runs until
+// closing is closed (graceful shutdown via Close) or a write fails (the peer
+// is gone), at which point it closes the underlying connection and signals
+// Done.
+func (sc *SafeConn) writeLoop() {
+	defer close(sc.done)
+	defer sc.conn.Close()
+
+	for {
+		select {
+		case msg := <-sc.send:
+			if err := sc.write(msg); err != nil {
+				sc.setErr(err)
+				return
+			}
+		case <-sc.closing:
+			sc.drain()
+			return
+		}
+	}
+}
+
+// drain writes out any messages already sitting in the send queue when
+// closing fired, so Close does not silently discard pending writes. It gives
+// up at the first error.
+func (sc *SafeConn) drain() {
+	for {
+		select {
+		case msg := <-sc.send:
+			if err := sc.write(msg); err != nil {
+				sc.setErr(err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// write performs the underlying conn call for msg. It is only ever called
+// from the writer goroutine.
+func (sc *SafeConn) write(msg queuedMsg) error {
+	switch msg.kind {
+	case kindJSON:
+		sc.conn.SetWriteDeadline(sc.nextWriteDeadline())
+		return sc.conn.WriteJSON(msg.value)
+	case kindRaw:
+		sc.conn.SetWriteDeadline(sc.nextWriteDeadline())
+		return sc.conn.WriteMessage(msg.messageType, msg.data)
+	case kindPrepared:
+		sc.conn.SetWriteDeadline(sc.nextWriteDeadline())
+		return sc.conn.WritePreparedMessage(msg.prepared)
+	case kindControl:
+		return sc.conn.WriteControl(msg.messageType, msg.data, msg.deadline)
+	case kindEnableCompression:
+		sc.conn.EnableWriteCompression(msg.boolValue)
+		return nil
+	case kindSetCompressionLevel:
+		return sc.conn.SetCompressionLevel(msg.intValue)
+	default: // kindSetWriteDeadline
+		sc.writeDeadline = msg.deadline
+		return nil
+	}
+}
+
+// nextWriteDeadline returns the deadline to apply to the next data write: the
+// caller-supplied override from SetWriteDeadline if one is set, otherwise the
+// default derived from opts.WriteWait.
+func (sc *SafeConn) nextWriteDeadline() time.Time {
+	if !sc.writeDeadline.IsZero() {
+		return sc.writeDeadline
+	}
+	return time.Now().Add(sc.opts.WriteWait)
+}
+
+// enqueue hands msg to the writer goroutine, applying opts.FullQueuePolicy if
+// the send queue is already full.
+func (sc *SafeConn) enqueue(msg queuedMsg) error {
+	select {
+	case <-sc.closing:
+		return sc.doneErr()
+	case <-sc.done:
+		return sc.doneErr()
+	default:
+	}
+
+	select {
+	case sc.send <- msg:
+		return nil
+	case <-sc.closing:
+		return sc.doneErr()
+	default:
+	}
+
+	switch sc.opts.FullQueuePolicy {
+	case PolicyDropOldest:
+		select {
+		case <-sc.send:
+		default:
+		}
+		select {
+		case sc.send <- msg:
+			return nil
+		case <-sc.closing:
+			return sc.doneErr()
+		}
+	case PolicyClose:
+		sc.setErr(ErrSendQueueFull)
+		sc.Close()
+		return ErrSendQueueFull
+	default: // PolicyBlock
+		timer := time.NewTimer(sc.opts.WriteWait)
+		defer timer.Stop()
+		select {
+		case sc.send <- msg:
+			return nil
+		case <-sc.closing:
+			return sc.doneErr()
+		case <-timer.C:
+			return ErrSendQueueFull
+		}
+	}
+}
+
+func (sc *SafeConn) doneErr() error {
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return ErrConnClosed
+}
+
+func (sc *SafeConn) setErr(err error) {
 	sc.mu.Lock()
-	defer sc.mu.Unlock()
-	return sc.conn.WriteJSON(v)
+	if sc.err == nil {
+		sc.err = err
+	}
+	sc.mu.Unlock()
 }
 
-// WriteMessage writes a message to the connection in a thread-safe manner.
-func (sc *SafeConn) WriteMessage(messageType int, data []byte) error {
+// Err returns the error that caused the writer goroutine to exit, if any.
+func (sc *SafeConn) Err() error {
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
-	return sc.conn.WriteMessage(messageType, data)
+	return sc.err
+}
+
+// Done returns a channel that is closed once the writer goroutine has
+// exited, whether due to Close or a write failure. Callers can select on it
+// alongside ReadMessage to react promptly to a dead connection.
+func (sc *SafeConn) Done() <-chan struct{} {
+	return sc.done
+}
+
+// WriteJSON enqueues v to be JSON-encoded and written to the connection.
+// Enqueueing does not guarantee the write has completed - see
+// SafeConnOptions.FullQueuePolicy for what happens when the send queue is
+// full.
+func (sc *SafeConn) WriteJSON(v any) error {
+	return sc.enqueue(queuedMsg{kind: kindJSON, value: v})
+}
+
+// WriteMessage enqueues a message to be written to the connection. See
+// WriteJSON for the queueing semantics.
+func (sc *SafeConn) WriteMessage(messageType int, data []byte) error {
+	return sc.enqueue(queuedMsg{kind: kindRaw, messageType: messageType, data: data})
+}
+
+// WritePreparedMessage enqueues a pre-serialized message to be written to the
+// connection. Sending the same websocket.PreparedMessage to many connections
+// avoids re-encoding (and, if permessage-deflate is negotiated,
+// re-compressing) the same payload for every recipient. See Broadcast for a
+// higher-level fan-out helper.
+func (sc *SafeConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return sc.enqueue(queuedMsg{kind: kindPrepared, prepared: pm})
+}
+
+// WriteControl enqueues a control message (ping, pong, or close) to be
+// written to the connection, honoring deadline as the point by which the
+// underlying write must complete.
+func (sc *SafeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return sc.enqueue(queuedMsg{kind: kindControl, messageType: messageType, data: data, deadline: deadline})
+}
+
+// EnableWriteCompression enables or disables write compression for
+// subsequent messages. Like other writes, the change is applied by the
+// writer goroutine in order with queued messages, so it takes effect
+// starting with the next message enqueued after this call returns.
+func (sc *SafeConn) EnableWriteCompression(enabled bool) error {
+	return sc.enqueue(queuedMsg{kind: kindEnableCompression, boolValue: enabled})
+}
+
+// SetCompressionLevel sets the flate compression level used for subsequent
+// writes (see compress/flate for the meaning of level). See
+// EnableWriteCompression for when the change takes effect.
+func (sc *SafeConn) SetCompressionLevel(level int) error {
+	return sc.enqueue(queuedMsg{kind: kindSetCompressionLevel, intValue: level})
 }
 
 // ReadMessage reads a message from the connection.
 // Reading does not need synchronization as only one goroutine reads per connection.
+// If a read deadline has been set (see StartHeartbeat), ReadMessage returns an
+// error once the deadline elapses, signaling to the caller that the peer is
+// no longer alive and the connection should be torn down.
 func (sc *SafeConn) ReadMessage() (int, []byte, error) {
 	return sc.conn.ReadMessage()
 }
 
-// Close closes the underlying connection.
+// SetWriteDeadline overrides the deadline applied to each subsequent queued
+// write, replacing the default derived from SafeConnOptions.WriteWait. Like
+// other writer-goroutine state, the change is enqueued rather than applied
+// directly - calling sc.conn.SetWriteDeadline from this goroutine would race
+// with the writer goroutine's own SetWriteDeadline call before every write
+// (see write) - so it takes effect starting with the next message enqueued
+// after this call returns. Pass the zero Time to go back to the default.
+func (sc *SafeConn) SetWriteDeadline(t time.Time) error {
+	return sc.enqueue(queuedMsg{kind: kindSetWriteDeadline, deadline: t})
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection. Unlike
+// SetWriteDeadline, this is safe to call directly: ReadMessage runs on the
+// caller's own goroutine (see its doc comment), so there is no writer
+// goroutine to race with. It is, post-rework, the only deadline a caller can
+// set immediately rather than through the send queue.
+func (sc *SafeConn) SetReadDeadline(t time.Time) error {
+	return sc.conn.SetReadDeadline(t)
+}
+
+// StartHeartbeat starts a goroutine that sends a websocket.PingMessage to the
+// peer every interval, and installs a PongHandler that extends the
+// connection's read deadline by pongWait each time a pong is seen. Once the
+// read deadline elapses without a pong, ReadMessage returns an error so the
+// caller's read loop can detect the dead peer and tear down the connection.
+//
+// StartHeartbeat must be called before the caller's read loop begins, since
+// it installs the PongHandler and sets the initial read deadline.
+func (sc *SafeConn) StartHeartbeat(interval, pongWait time.Duration) {
+	sc.conn.SetReadDeadline(time.Now().Add(pongWait))
+	sc.conn.SetPongHandler(func(string) error {
+		return sc.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sc.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the writer goroutine, flushing any messages already queued,
+// and closes the underlying connection. It blocks until the writer goroutine
+// has exited. Close is idempotent.
 func (sc *SafeConn) Close() error {
-	return sc.conn.Close()
+	sc.closeOnce.Do(func() {
+		close(sc.closing)
+	})
+	<-sc.done
+	return sc.Err()
 }
 
 // Conn returns the underlying websocket connection.
-// Use with caution - direct access bypasses synchronization.
+// Use with caution - direct access bypasses the send queue and writer goroutine.
 func (sc *SafeConn) Conn() *websocket.Conn {
 	return sc.conn
 }
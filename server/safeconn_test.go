@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -152,6 +153,66 @@ func TestSafeConnWriteMessage(t *testing.T) {
 	}
 }
 
+// TestSafeConnStartHeartbeat tests that StartHeartbeat sends a ping to the
+// peer shortly after it is started.
+func TestSafeConnStartHeartbeat(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	serverReady := make(chan struct{})
+	var serverConn *websocket.Conn
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		serverConn = conn
+		close(serverReady)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + server.URL[4:]
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientConn.Close()
+
+	<-serverReady
+	defer serverConn.Close()
+
+	pings := make(chan struct{}, 10)
+	clientConn.SetPingHandler(func(appData string) error {
+		pings <- struct{}{}
+		return clientConn.WriteControl(websocket.PongMessage, nil, time.Now().Add(writeWait))
+	})
+	go func() {
+		for {
+			if _, _, err := clientConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	safeConn := NewSafeConn(serverConn)
+	safeConn.StartHeartbeat(20*time.Millisecond, 200*time.Millisecond)
+
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for ping")
+	}
+}
+
 // TestSafeConnReadMessage tests ReadMessage method.
 func TestSafeConnReadMessage(t *testing.T) {
 	upgrader := websocket.Upgrader{
@@ -201,3 +262,238 @@ func TestSafeConnReadMessage(t *testing.T) {
 		t.Errorf("Expected 'hello from server', got %q", data)
 	}
 }
+
+// TestSafeConnCompressionPassthroughs tests that EnableWriteCompression and
+// SetCompressionLevel are accepted and don't disrupt subsequent writes.
+func TestSafeConnCompressionPassthroughs(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		EnableCompression: true,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+	}
+
+	serverReady := make(chan struct{})
+	received := make(chan []byte, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		close(serverReady)
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Errorf("Server read failed: %v", err)
+			return
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	wsURL := "ws" + server.URL[4:]
+	clientConn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientConn.Close()
+
+	<-serverReady
+
+	safeConn := NewSafeConn(clientConn)
+	if err := safeConn.EnableWriteCompression(true); err != nil {
+		t.Fatalf("EnableWriteCompression failed: %v", err)
+	}
+	if err := safeConn.SetCompressionLevel(6); err != nil {
+		t.Fatalf("SetCompressionLevel failed: %v", err)
+	}
+
+	payload := []byte("test message")
+	if err := safeConn.WriteMessage(websocket.TextMessage, payload); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	select {
+	case msg := <-received:
+		if string(msg) != string(payload) {
+			t.Errorf("Expected %q, got %q", payload, msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+}
+
+// TestSafeConnSetWriteDeadlineOverride tests that a write still succeeds
+// after SetWriteDeadline has set a generous deadline, and that calling
+// SetWriteDeadline concurrently with writes is race-free under -race.
+func TestSafeConnSetWriteDeadlineOverride(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	serverReady := make(chan struct{})
+	var serverConn *websocket.Conn
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		serverConn = conn
+		close(serverReady)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + server.URL[4:]
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientConn.Close()
+
+	<-serverReady
+	defer serverConn.Close()
+
+	safeConn := NewSafeConn(serverConn)
+
+	// A generous deadline set ahead of time should not prevent a normal
+	// write from succeeding.
+	if err := safeConn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetWriteDeadline failed: %v", err)
+	}
+	if err := safeConn.WriteJSON(map[string]string{"foo": "bar"}); err != nil {
+		t.Errorf("WriteJSON failed: %v", err)
+	}
+
+	// Concurrently calling SetWriteDeadline alongside writes must not race
+	// with the writer goroutine's own deadline handling.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			safeConn.SetWriteDeadline(time.Now().Add(time.Second))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			safeConn.WriteJSON(map[string]int{"i": i})
+		}
+	}()
+	wg.Wait()
+}
+
+// TestSafeConnCloseSignalsDone tests that Close stops the writer goroutine
+// and that subsequent writes report ErrConnClosed.
+func TestSafeConnCloseSignalsDone(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	serverReady := make(chan struct{})
+	var serverConn *websocket.Conn
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		serverConn = conn
+		close(serverReady)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + server.URL[4:]
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientConn.Close()
+
+	<-serverReady
+
+	safeConn := NewSafeConn(serverConn)
+	if err := safeConn.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	select {
+	case <-safeConn.Done():
+	default:
+		t.Fatal("Done() not closed after Close()")
+	}
+
+	if err := safeConn.WriteJSON(map[string]string{"foo": "bar"}); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected ErrConnClosed, got %v", err)
+	}
+}
+
+// TestSafeConnFullQueuePolicyClose tests that PolicyClose closes the
+// connection once the send queue is full instead of blocking the caller.
+func TestSafeConnFullQueuePolicyClose(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	serverReady := make(chan struct{})
+	var serverConn *websocket.Conn
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		serverConn = conn
+		close(serverReady)
+		// Deliberately never read, so the peer's TCP buffers fill up and
+		// writes from the server side eventually block.
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + server.URL[4:]
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientConn.Close()
+
+	<-serverReady
+
+	safeConn := NewSafeConnWithOptions(serverConn, SafeConnOptions{
+		SendBufferSize:  0,
+		WriteWait:       100 * time.Millisecond,
+		FullQueuePolicy: PolicyClose,
+	})
+
+	large := make([]byte, 8<<20)
+	var lastErr error
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lastErr = safeConn.WriteMessage(websocket.BinaryMessage, large)
+		if lastErr != nil {
+			break
+		}
+	}
+
+	if !errors.Is(lastErr, ErrSendQueueFull) {
+		t.Fatalf("Expected ErrSendQueueFull once the unread peer backs up, got %v", lastErr)
+	}
+
+	select {
+	case <-safeConn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected writer goroutine to exit after PolicyClose")
+	}
+}
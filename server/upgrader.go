@@ -0,0 +1,77 @@
+package server
+
+import (
+	"compress/flate"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// UpgraderOptions configures the Upgrader returned by NewUpgrader.
+type UpgraderOptions struct {
+	// EnableCompression turns on permessage-deflate negotiation for
+	// connections upgraded through this Upgrader. NFC event payloads (card
+	// dumps, APDU traces) are highly compressible JSON, so this cuts
+	// bandwidth significantly on mobile and remote-admin links.
+	EnableCompression bool
+	// CompressionLevel is the flate compression level applied to each
+	// connection once upgraded (see compress/flate for the meaning of
+	// level). Only used when EnableCompression is true. The zero value
+	// selects flate.DefaultCompression rather than flate.NoCompression
+	// (which is also zero), since a caller that only set EnableCompression
+	// almost certainly wants compressed output, not an explicit opt-out.
+	CompressionLevel int
+
+	// There are no ServerNoContextTakeover, ClientNoContextTakeover, or
+	// window-bits fields here. gorilla/websocket hardcodes
+	// no-context-takeover on both the read and write side of every
+	// permessage-deflate connection it establishes and does not expose
+	// control over the deflate window size at all, so options for any of
+	// that would be dead knobs a caller could set without error and without
+	// effect. If gorilla ever exposes this negotiation, add the fields then
+	// and wire them into Upgrade.
+}
+
+// Upgrader wraps a websocket.Upgrader configured for permessage-deflate,
+// applying the negotiated compression settings to each connection as soon as
+// it is upgraded.
+type Upgrader struct {
+	websocket.Upgrader
+	opts UpgraderOptions
+}
+
+// NewUpgrader returns an Upgrader configured per opts. Callers should set the
+// usual websocket.Upgrader fields (CheckOrigin, ReadBufferSize, ...) on the
+// returned value's embedded Upgrader before use.
+func NewUpgrader(opts UpgraderOptions) *Upgrader {
+	u := &Upgrader{opts: opts}
+	u.Upgrader.EnableCompression = opts.EnableCompression
+	return u
+}
+
+// Upgrade upgrades the HTTP connection to a websocket connection and, if
+// compression is enabled, applies opts.CompressionLevel to it.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+	conn, err := u.Upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.opts.EnableCompression {
+		conn.EnableWriteCompression(true)
+		conn.SetCompressionLevel(effectiveCompressionLevel(u.opts.CompressionLevel))
+	}
+
+	return conn, nil
+}
+
+// effectiveCompressionLevel maps an UpgraderOptions.CompressionLevel value
+// to the level actually applied to a connection: the zero value (Go's
+// default for an unset int field) selects flate.DefaultCompression rather
+// than flate.NoCompression, which is also zero.
+func effectiveCompressionLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
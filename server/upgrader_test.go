@@ -0,0 +1,83 @@
+package server
+
+import (
+	"compress/flate"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestEffectiveCompressionLevelDefaultsZero tests that an unset
+// CompressionLevel selects flate.DefaultCompression rather than the
+// zero-valued flate.NoCompression.
+func TestEffectiveCompressionLevelDefaultsZero(t *testing.T) {
+	if got := effectiveCompressionLevel(0); got != flate.DefaultCompression {
+		t.Errorf("Expected flate.DefaultCompression for unset level, got %d", got)
+	}
+	if got := effectiveCompressionLevel(9); got != 9 {
+		t.Errorf("Expected explicit level 9 to pass through, got %d", got)
+	}
+}
+
+// TestNewUpgraderAppliesCompression tests that an Upgrader built with
+// EnableCompression negotiates compression and that messages still round
+// trip correctly over the compressed connection.
+func TestNewUpgraderAppliesCompression(t *testing.T) {
+	upgrader := NewUpgrader(UpgraderOptions{
+		EnableCompression: true,
+		CompressionLevel:  6,
+	})
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+
+	serverReady := make(chan struct{})
+	received := make(chan []byte, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		close(serverReady)
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Errorf("Server read failed: %v", err)
+			return
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	wsURL := "ws" + server.URL[4:]
+	clientConn, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientConn.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("Expected permessage-deflate to be negotiated, got extensions %q", ext)
+	}
+
+	<-serverReady
+
+	payload := []byte(`{"event":"card-detected","uid":"04A1B2C3"}`)
+	if err := clientConn.WriteMessage(websocket.TextMessage, payload); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	select {
+	case msg := <-received:
+		if string(msg) != string(payload) {
+			t.Errorf("Expected %q, got %q", payload, msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+}